@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestBatchRunsConcurrentlyAndPreservesOrder drives three batched operations
+// whose Executor finishes in the reverse of request order (by sleeping
+// longer for earlier operations), then asserts the response is still
+// ordered to match the request -- not completion order -- and that the
+// operations actually overlapped instead of running one at a time.
+func TestBatchRunsConcurrentlyAndPreservesOrder(t *testing.T) {
+	var mu sync.Mutex
+	var completionOrder []int
+
+	h := &Handler{
+		Executor: func(request *Request) interface{} {
+			index, _ := strconv.Atoi(request.OperationName)
+			time.Sleep(time.Duration(3-index) * 20 * time.Millisecond)
+			mu.Lock()
+			completionOrder = append(completionOrder, index)
+			mu.Unlock()
+			return map[string]interface{}{"op": index}
+		},
+	}
+
+	body := `[{"operationName":"0","query":"{a}"},{"operationName":"1","query":"{a}"},{"operationName":"2","query":"{a}"}]`
+	req := httptest.NewRequest("POST", "/graphql", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	var results []map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	for i, res := range results {
+		if op := int(res["op"].(float64)); op != i {
+			t.Fatalf("results[%d] = op %d, want op %d (response order doesn't match request order)", i, op, i)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if completionOrder[0] != 2 {
+		t.Fatalf("completion order = %v, want operation 2 (shortest sleep) to finish first -- operations may be running sequentially, not concurrently", completionOrder)
+	}
+}
+
+// TestBatchOperationCancellationDoesNotAffectSiblings guards the per-op
+// context.WithCancel in the batch branch: each operation's context is
+// cancelled on its own goroutine's way out, and that must not be visible to
+// a sibling operation still running under its own, independently-derived
+// context.
+func TestBatchOperationCancellationDoesNotAffectSiblings(t *testing.T) {
+	fastDone := make(chan struct{})
+	slowCtxErr := make(chan error, 1)
+
+	h := &Handler{
+		Executor: func(request *Request) interface{} {
+			switch request.OperationName {
+			case "fast":
+				close(fastDone)
+				return map[string]interface{}{"ok": true}
+			case "slow":
+				<-fastDone
+				// Give the fast operation's deferred cancel() time to run
+				// before we check whether it leaked into our own context.
+				time.Sleep(20 * time.Millisecond)
+				slowCtxErr <- request.Context.Err()
+				return map[string]interface{}{"ok": true}
+			default:
+				return nil
+			}
+		},
+	}
+
+	body := `[{"operationName":"fast","query":"{a}"},{"operationName":"slow","query":"{a}"}]`
+	req := httptest.NewRequest("POST", "/graphql", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body.String())
+	}
+
+	select {
+	case err := <-slowCtxErr:
+		if err != nil {
+			t.Fatalf("slow operation's context was cancelled by the fast operation finishing: %v", err)
+		}
+	default:
+		t.Fatal("slow operation's Executor never ran")
+	}
+}
@@ -5,19 +5,62 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"mime/multipart"
+	"io"
+	"log"
 	"net"
 	"net/http"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 )
 
 type Handler struct {
-	MaxBodySize int64 // in bytes
-	Executor    Executor
-	Client      bool
+	MaxBodySize         int64 // in bytes
+	MaxFileSize         int64 // per-file cap enforced while spooling a multipart upload part to disk, in bytes
+	MaxFiles            int   // max number of file parts accepted in a single multipart request
+	MaxBatchSize        int   // max number of operations accepted in a single batch request; 0 means unlimited
+	MaxBatchConcurrency int   // max number of batch operations executed concurrently; 0 means unlimited
+	Executor            Executor
+	Subscriber          Subscriber   // optional; enables the /subscriptions websocket upgrade
+	ErrorHandler        ErrorHandler // optional; defaults to logging the error
+	PanicHandler        PanicHandler // optional; defaults to turning the recovered value into an error
+	Client              bool
+}
+
+// ErrorHandler is notified of errors that happen outside GraphQL execution
+// proper -- malformed request bodies, a failed response write, and the
+// like -- so they can be reported (metrics, Sentry, ...) instead of only
+// ever crashing the process via panic. Broken-pipe (EPIPE) errors from a
+// client that hung up are dropped without being reported. ctx is the
+// request's context; it carries the same "header"/"remote-ip" values as
+// the Request passed to Executor only for errors from a panicking
+// Executor call.
+type ErrorHandler func(ctx context.Context, err error)
+
+func defaultErrorHandler(ctx context.Context, err error) {
+	log.Printf("graphql-upload: %v", err)
+}
+
+// PanicHandler recovers a panicking Executor call so a single bad resolver
+// cannot take down the HTTP server, and turns the recovered value into the
+// error surfaced to the client as a GraphQL error.
+type PanicHandler func(ctx context.Context, recovered interface{}) error
+
+func defaultPanicHandler(ctx context.Context, recovered interface{}) error {
+	return fmt.Errorf("panic: %v", recovered)
+}
+
+// gqlError and gqlErrorResponse shape error responses the way the GraphQL
+// spec expects: `{"errors": [{"message": "..."}]}`.
+type gqlError struct {
+	Message string `json:"message"`
+}
+
+type gqlErrorResponse struct {
+	Errors []gqlError `json:"errors"`
 }
 
 type Request struct {
@@ -27,10 +70,20 @@ type Request struct {
 	Context       context.Context
 }
 
-func set(v interface{}, m interface{}, path string) error {
+// set writes v into *root at the given dot-separated path, auto-vivifying
+// missing intermediate objects/arrays (and growing arrays to fit, padding
+// with null placeholders) as it goes.
+//
+// Growing a slice can reallocate its backing array, so a grown container
+// is only visible to the rest of the tree if it is written back into
+// whatever slot produced it (the parent map key or array index, or root
+// itself). getCurrent/setCurrent below track that slot as traversal descends so each
+// level can write itself back after growing, instead of mutating a local
+// copy that silently never reaches the tree the caller holds.
+func set(v interface{}, root *interface{}, path string) error {
 	var parts []interface{}
 	for _, p := range strings.Split(path, ".") {
-		if isNumber, err := regexp.MatchString(`\d+`, p); err != nil {
+		if isNumber, err := regexp.MatchString(`^\d+$`, p); err != nil {
 			return err
 		} else if isNumber {
 			index, _ := strconv.Atoi(p)
@@ -39,30 +92,118 @@ func set(v interface{}, m interface{}, path string) error {
 			parts = append(parts, p)
 		}
 	}
+
+	getCurrent := func() interface{} { return *root }
+	setCurrent := func(nv interface{}) { *root = nv }
+
 	for i, p := range parts {
 		last := i == len(parts)-1
+		current := getCurrent()
 		switch idx := p.(type) {
 		case string:
+			container, ok := current.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("path %q: expected an object at %q, got %T", path, idx, current)
+			}
 			if last {
-				m.(map[string]interface{})[idx] = v
-			} else {
-				m = m.(map[string]interface{})[idx]
+				container[idx] = v
+				return nil
+			}
+			next := container[idx]
+			if next == nil {
+				next = newContainer(parts[i+1])
+				container[idx] = next
 			}
+			getCurrent = func() interface{} { return container[idx] }
+			setCurrent = func(nv interface{}) { container[idx] = nv }
 		case int:
+			container, ok := current.([]interface{})
+			if !ok {
+				return fmt.Errorf("path %q: expected an array at index %d, got %T", path, idx, current)
+			}
+			// auto-create the slot when operations carries a `null`
+			// placeholder (or no placeholder at all) for this file,
+			// then write the (possibly reallocated) slice back into
+			// whatever slot it came from.
+			for idx >= len(container) {
+				container = append(container, nil)
+			}
+			setCurrent(container)
 			if last {
-				m.([]interface{})[idx] = v
-			} else {
-				m = m.([]interface{})[idx]
+				container[idx] = v
+				return nil
 			}
+			next := container[idx]
+			if next == nil {
+				next = newContainer(parts[i+1])
+				container[idx] = next
+			}
+			getCurrent = func() interface{} { return container[idx] }
+			setCurrent = func(nv interface{}) { container[idx] = nv }
 		}
 	}
 	return nil
 }
 
-type File struct {
-	File     multipart.File
-	Filename string
-	Size     int64
+// newContainer returns an empty map or slice, chosen by the kind of the
+// next path segment, so that set() can auto-vivify missing intermediate
+// objects/arrays instead of requiring operations to pre-populate them.
+func newContainer(nextPart interface{}) interface{} {
+	if _, ok := nextPart.(int); ok {
+		return []interface{}{}
+	}
+	return map[string]interface{}{}
+}
+
+// Upload is the scalar substituted into `variables` for every path listed
+// against a multipart file part in the `map` field, mirroring the shape
+// used by gqlgen and nautilus/graphql so resolvers can depend on a single
+// well-defined type regardless of GraphQL server implementation.
+//
+// File is spooled to a temp file while its multipart part is still
+// current (a *multipart.Part stops being readable once the next part is
+// read), removed automatically once ServeHTTP returns, so it remains
+// valid for the lifetime of the Executor call this Upload was handed to.
+// Size is the number of bytes actually read, which may be smaller than a
+// Content-Length the client sent.
+type Upload struct {
+	File        io.Reader
+	Filename    string
+	Size        int64
+	ContentType string
+}
+
+// Read implements io.Reader by delegating to the underlying file.
+func (u Upload) Read(p []byte) (int, error) {
+	return u.File.Read(p)
+}
+
+// Close implements io.Closer by delegating to the underlying file, if it
+// is closable.
+func (u Upload) Close() error {
+	if closer, ok := u.File.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// MarshalUpload renders an Upload the way resolvers return it to the
+// GraphQL layer: as itself, since Upload already carries the shape
+// schemas expect for the Upload scalar.
+func MarshalUpload(u Upload) interface{} {
+	return u
+}
+
+// UnmarshalUpload recovers the Upload injected by the multipart handler
+// from a resolver argument. It returns an error if v was not produced by
+// this package, e.g. because the client sent the Upload variable inline
+// instead of as a multipart file part.
+func UnmarshalUpload(v interface{}) (Upload, error) {
+	upload, ok := v.(Upload)
+	if !ok {
+		return Upload{}, fmt.Errorf("%T is not a graphql-upload Upload", v)
+	}
+	return upload, nil
 }
 
 type Config struct {
@@ -79,12 +220,100 @@ func New(executor Executor, config *Config) *Handler {
 	}
 }
 
-func errHandler(err error) {
+// execute calls self.Executor, recovering a panicking resolver via
+// self.PanicHandler so it becomes a GraphQL error in the response instead
+// of crashing the server.
+func (self *Handler) execute(request *Request) (result interface{}) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			handler := self.PanicHandler
+			if handler == nil {
+				handler = defaultPanicHandler
+			}
+			err := handler(request.Context, recovered)
+			self.reportError(request.Context, err)
+			result = gqlErrorResponse{Errors: []gqlError{{Message: err.Error()}}}
+		}
+	}()
+	return self.Executor(request)
+}
+
+// reportError notifies self.ErrorHandler (or the default logger) without
+// touching the response, for errors discovered after the response is
+// already written or otherwise not ours to report to the client (e.g.
+// encoding the batch response failed). Broken-pipe (EPIPE) errors from a
+// client that disconnected mid-write are dropped without being reported.
+func (self *Handler) reportError(ctx context.Context, err error) {
+	if errors.Is(err, syscall.EPIPE) {
+		return
+	}
+	handler := self.ErrorHandler
+	if handler == nil {
+		handler = defaultErrorHandler
+	}
+	handler(ctx, err)
+}
+
+// writeError reports err and, unless it is a client disconnect we have no
+// one left to write to, responds with status and a GraphQL-shaped error
+// body instead of the panic this package used to raise.
+func (self *Handler) writeError(ctx context.Context, w http.ResponseWriter, status int, err error) {
 	if errors.Is(err, syscall.EPIPE) {
 		return
-	} else {
-		panic(err)
 	}
+	self.reportError(ctx, err)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(gqlErrorResponse{Errors: []gqlError{{Message: err.Error()}}})
+}
+
+// isBodyTooLarge reports whether err was produced by a reader wrapped with
+// http.MaxBytesReader once the configured limit was exceeded.
+func isBodyTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "http: request body too large")
+}
+
+// errFileTooLarge is returned by readPart when a part has more than
+// maxSize bytes, so callers can tell it apart from a genuine read error.
+var errFileTooLarge = errors.New("file exceeds the configured size limit")
+
+// readPart spools a multipart part to a temp file, since it stops being
+// readable as soon as the caller advances to the next part and may be too
+// large to hold in memory at once -- the same tradeoff r.ParseMultipartForm
+// made for its file parts, rather than holding every upload in RAM
+// regardless of size. The caller is responsible for removing the returned file once it is no
+// longer needed.
+//
+// If maxSize is positive, readPart reads one byte past it to detect
+// (rather than silently truncate) an oversized upload, returning
+// errFileTooLarge. It returns the spooled file along with the part's real
+// size, so Upload.Size reflects what was actually uploaded.
+func readPart(part io.Reader, maxSize int64) (*os.File, int64, error) {
+	tmp, err := os.CreateTemp("", "graphql-upload-*")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	src := io.Reader(part)
+	if maxSize > 0 {
+		src = io.LimitReader(part, maxSize+1)
+	}
+	n, err := io.Copy(tmp, src)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, 0, err
+	}
+	if maxSize > 0 && n > maxSize {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, 0, errFileTooLarge
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, 0, err
+	}
+	return tmp, n, nil
 }
 
 func (self *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -93,6 +322,15 @@ func (self *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var operations interface{}
 	remoteIp := getRemoteIp(r)
 
+	if isWebsocketUpgrade(r) && strings.HasSuffix(r.URL.Path, "/subscriptions") {
+		self.serveWS(w, r)
+		return
+	}
+
+	if self.MaxBodySize > 0 && r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, self.MaxBodySize)
+	}
+
 	if r.Method == "GET" {
 		request := Request{Context: context.WithValue(r.Context(), "header", r.Header)}
 		request.Context = context.WithValue(request.Context, "remote-ip", remoteIp)
@@ -121,7 +359,7 @@ func (self *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		} else {
 			request.OperationName = value
 		}
-		result := self.Executor(&request)
+		result := self.execute(&request)
 		if err := json.NewEncoder(w).Encode(result); err != nil {
 			message := fmt.Sprintf("Bad operation name")
 			http.Error(w, message, http.StatusBadRequest)
@@ -134,52 +372,146 @@ func (self *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		case "text/plain", "application/json":
 			if r.ContentLength > 0 {
 				if err := json.NewDecoder(r.Body).Decode(&operations); err != nil {
+					if isBodyTooLarge(err) {
+						self.writeError(r.Context(), w, http.StatusRequestEntityTooLarge, errors.New("Request body too large"))
+						return
+					}
 					message := fmt.Sprintf("JSON syntax error")
 					http.Error(w, message, http.StatusBadRequest)
 					return
 				}
 			}
 		case "multipart/form-data":
-			// Parse multipart form
-			if err := r.ParseMultipartForm(self.MaxBodySize); err != nil {
-				errHandler(err)
+			// Read the multipart body directly via r.MultipartReader
+			// instead of r.ParseMultipartForm, which buffers every field
+			// into memory before any of this code runs. The GraphQL
+			// multipart request spec requires the `operations` and `map`
+			// fields to precede the file parts, so we read them in a
+			// single pass, spooling each file part to a temp file (see
+			// readPart) while it is still the current part -- a
+			// *multipart.Part stops being readable the moment the next
+			// one is requested, and the Executor this Upload is handed to
+			// only runs once every part has been walked, so its content
+			// cannot be read lazily from the live Part.
+			//
+			// This still reads one whole file at a time rather than
+			// letting a resolver stream a part as its bytes arrive off
+			// the wire: Executor is a single call that expects a fully
+			// populated Request up front, including the Filename on every
+			// Upload, and a part's Filename isn't known until its turn in
+			// the body arrives. Making that lazy would mean handing
+			// Executor Upload values whose fields mutate after the call
+			// already started -- a data race, not a feature. Spooling to
+			// a temp file (removed once ServeHTTP returns, see
+			// uploadTempFiles below) at least bounds memory the way
+			// r.ParseMultipartForm always did, instead of holding the
+			// whole file in RAM.
+			var uploadTempFiles []string
+			defer func() {
+				for _, name := range uploadTempFiles {
+					os.Remove(name)
+				}
+			}()
+
+			mr, err := r.MultipartReader()
+			if err != nil {
+				if isBodyTooLarge(err) {
+					self.writeError(r.Context(), w, http.StatusRequestEntityTooLarge, errors.New("Request body too large"))
+					return
+				}
+				self.writeError(r.Context(), w, http.StatusBadRequest, fmt.Errorf("Bad multipart request: %w", err))
+				return
 			}
 
-			// Unmarshal uploads
-			var uploads = map[File][]string{}
+			operationsPart, err := mr.NextPart()
+			if err != nil || operationsPart.FormName() != "operations" {
+				self.writeError(r.Context(), w, http.StatusBadRequest, errors.New("multipart request must send operations before map and files"))
+				return
+			}
+			if err := json.NewDecoder(operationsPart).Decode(&operations); err != nil {
+				self.writeError(r.Context(), w, http.StatusBadRequest, fmt.Errorf("JSON syntax error: %w", err))
+				return
+			}
+
+			mapPart, err := mr.NextPart()
+			if err != nil || mapPart.FormName() != "map" {
+				self.writeError(r.Context(), w, http.StatusBadRequest, errors.New("multipart request must send map before files"))
+				return
+			}
 			var uploadsMap = map[string][]string{}
-			if err := json.Unmarshal([]byte(r.Form.Get("map")), &uploadsMap); err != nil {
-				message := fmt.Sprintf("JSON syntax error")
-				http.Error(w, message, http.StatusBadRequest)
+			if err := json.NewDecoder(mapPart).Decode(&uploadsMap); err != nil {
+				self.writeError(r.Context(), w, http.StatusBadRequest, fmt.Errorf("JSON syntax error: %w", err))
 				return
-			} else {
-				for key, path := range uploadsMap {
-					if file, header, err := r.FormFile(key); err != nil {
-						message := fmt.Sprintf("JSON syntax error")
-						http.Error(w, message, http.StatusBadRequest)
+			}
+			for key, paths := range uploadsMap {
+				if len(paths) == 0 {
+					self.writeError(r.Context(), w, http.StatusBadRequest, fmt.Errorf("map.%s does not resolve to any path under variables", key))
+					return
+				}
+				for _, path := range paths {
+					if path != "variables" && !strings.HasPrefix(path, "variables.") {
+						self.writeError(r.Context(), w, http.StatusBadRequest, fmt.Errorf("map.%s: path %q does not resolve under variables", key, path))
 						return
-					} else {
-						uploads[File{
-							File:     file,
-							Size:     header.Size,
-							Filename: header.Filename,
-						}] = path
 					}
 				}
 			}
 
-			// Unmarshal operations
-			if err := json.Unmarshal([]byte(r.Form.Get("operations")), &operations); err != nil {
-				message := fmt.Sprintf("JSON syntax error")
-				http.Error(w, message, http.StatusBadRequest)
-				return
-			}
+			fileCount := 0
+			for {
+				part, err := mr.NextPart()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					if isBodyTooLarge(err) {
+						self.writeError(r.Context(), w, http.StatusRequestEntityTooLarge, errors.New("Request body too large"))
+						return
+					}
+					self.writeError(r.Context(), w, http.StatusBadRequest, fmt.Errorf("Bad multipart request: %w", err))
+					return
+				}
+
+				key := part.FormName()
+				paths, ok := uploadsMap[key]
+				if !ok {
+					self.writeError(r.Context(), w, http.StatusBadRequest, fmt.Errorf("multipart request has a file for %q not present in map", key))
+					return
+				}
 
-			// set uploads to operations
-			for file, paths := range uploads {
+				fileCount++
+				if self.MaxFiles > 0 && fileCount > self.MaxFiles {
+					self.writeError(r.Context(), w, http.StatusRequestEntityTooLarge, fmt.Errorf("multipart request exceeds the %d file limit", self.MaxFiles))
+					return
+				}
+
+				// A *multipart.Part is only readable until the next
+				// NextPart() call, but every Upload must still be
+				// readable once Executor runs after this whole loop
+				// finishes walking the request body. So spool each part
+				// to a temp file now, while it is still current, instead
+				// of handing resolvers a Part that will read back empty.
+				// This also gives us the part's real size and a point to
+				// detect a part that exceeds MaxFileSize, rather than
+				// silently truncating it.
+				tmp, size, err := readPart(part, self.MaxFileSize)
+				if err != nil {
+					if err == errFileTooLarge {
+						self.writeError(r.Context(), w, http.StatusRequestEntityTooLarge, fmt.Errorf("uploaded file %q exceeds the %d byte limit", key, self.MaxFileSize))
+						return
+					}
+					self.writeError(r.Context(), w, http.StatusBadRequest, err)
+					return
+				}
+				uploadTempFiles = append(uploadTempFiles, tmp.Name())
+				upload := Upload{
+					File:        tmp,
+					Filename:    part.FileName(),
+					Size:        size,
+					ContentType: part.Header.Get("Content-Type"),
+				}
 				for _, path := range paths {
-					if err := set(file, operations, path); err != nil {
-						errHandler(err)
+					if err := set(upload, &operations, path); err != nil {
+						self.writeError(r.Context(), w, http.StatusBadRequest, err)
+						return
 					}
 				}
 			}
@@ -204,37 +536,69 @@ func (self *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 			request.Context = context.WithValue(r.Context(), "header", r.Header)
 			request.Context = context.WithValue(request.Context, "remote-ip", remoteIp)
-			if err := json.NewEncoder(w).Encode(self.Executor(&request)); err != nil {
+			if err := json.NewEncoder(w).Encode(self.execute(&request)); err != nil {
 				message := fmt.Sprintf("JSON syntax error")
 				http.Error(w, message, http.StatusBadRequest)
 				return
 			}
 		case []interface{}:
+			if self.MaxBatchSize > 0 && len(data) > self.MaxBatchSize {
+				self.writeError(r.Context(), w, http.StatusBadRequest, fmt.Errorf("batch request exceeds the %d operation limit", self.MaxBatchSize))
+				return
+			}
+
+			// Run every operation concurrently, each with its own context
+			// derived from the request context, so a slow or cancelled op
+			// cannot block or take down its siblings. Results are written
+			// into `result` by index, so ordering still matches the
+			// request regardless of completion order.
+			concurrency := self.MaxBatchConcurrency
+			if concurrency <= 0 || concurrency > len(data) {
+				concurrency = len(data)
+			}
 			result := make([]interface{}, len(data))
+			sem := make(chan struct{}, concurrency)
+			var wg sync.WaitGroup
 			for index, operation := range data {
-				data := operation.(map[string]interface{})
-				request := Request{}
-				if value, ok := data["operationName"]; ok {
-					if tmp, ok := value.(string); ok {
-						request.OperationName = tmp
-					}
+				data, ok := operation.(map[string]interface{})
+				if !ok {
+					result[index] = gqlErrorResponse{Errors: []gqlError{{Message: "operation must be an object"}}}
+					continue
 				}
-				if value, ok := data["query"]; ok {
-					if tmp, ok := value.(string); ok {
-						request.Query = tmp
+
+				wg.Add(1)
+				sem <- struct{}{}
+				go func(index int, data map[string]interface{}) {
+					defer wg.Done()
+					defer func() { <-sem }()
+
+					request := Request{}
+					if value, ok := data["operationName"]; ok {
+						if tmp, ok := value.(string); ok {
+							request.OperationName = tmp
+						}
 					}
-				}
-				if value, ok := data["variables"]; ok {
-					if tmp, ok := value.(map[string]interface{}); ok {
-						request.Variables = tmp
+					if value, ok := data["query"]; ok {
+						if tmp, ok := value.(string); ok {
+							request.Query = tmp
+						}
 					}
-				}
-				request.Context = context.WithValue(r.Context(), "header", r.Header)
-				request.Context = context.WithValue(request.Context, "remote-ip", remoteIp)
-				result[index] = self.Executor(&request)
+					if value, ok := data["variables"]; ok {
+						if tmp, ok := value.(map[string]interface{}); ok {
+							request.Variables = tmp
+						}
+					}
+					opCtx, cancel := context.WithCancel(r.Context())
+					defer cancel()
+					request.Context = context.WithValue(opCtx, "header", r.Header)
+					request.Context = context.WithValue(request.Context, "remote-ip", remoteIp)
+					result[index] = self.execute(&request)
+				}(index, data)
 			}
+			wg.Wait()
+
 			if err := json.NewEncoder(w).Encode(result); err != nil {
-				errHandler(err)
+				self.reportError(r.Context(), err)
 			}
 		default:
 			w.WriteHeader(http.StatusBadRequest)
@@ -0,0 +1,323 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newMultipartUploadRequest builds a GraphQL multipart request (operations,
+// map, then a single file part named "file") carrying content as the
+// uploaded file's bytes, mirroring the shape a real client sends.
+func newMultipartUploadRequest(t *testing.T, content []byte) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	operationsPart, err := mw.CreateFormField("operations")
+	if err != nil {
+		t.Fatalf("CreateFormField(operations): %v", err)
+	}
+	if _, err := operationsPart.Write([]byte(`{"query":"{ upload(file: $file) }","variables":{"file":null}}`)); err != nil {
+		t.Fatalf("write operations part: %v", err)
+	}
+
+	mapPart, err := mw.CreateFormField("map")
+	if err != nil {
+		t.Fatalf("CreateFormField(map): %v", err)
+	}
+	if _, err := mapPart.Write([]byte(`{"file":["variables.file"]}`)); err != nil {
+		t.Fatalf("write map part: %v", err)
+	}
+
+	filePart, err := mw.CreateFormFile("file", "upload.txt")
+	if err != nil {
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+	if _, err := filePart.Write(content); err != nil {
+		t.Fatalf("write file part: %v", err)
+	}
+
+	if err := mw.Close(); err != nil {
+		t.Fatalf("close multipart writer: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/graphql", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+// newMultipartRequestWithMap builds a multipart request with an arbitrary
+// (possibly invalid) `map` field and a single file part named "file", to
+// exercise the map-validation rejected before any file is read.
+func newMultipartRequestWithMap(t *testing.T, mapJSON string) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	operationsPart, err := mw.CreateFormField("operations")
+	if err != nil {
+		t.Fatalf("CreateFormField(operations): %v", err)
+	}
+	if _, err := operationsPart.Write([]byte(`{"query":"{ upload(file: $file) }","variables":{"file":null}}`)); err != nil {
+		t.Fatalf("write operations part: %v", err)
+	}
+
+	mapPart, err := mw.CreateFormField("map")
+	if err != nil {
+		t.Fatalf("CreateFormField(map): %v", err)
+	}
+	if _, err := mapPart.Write([]byte(mapJSON)); err != nil {
+		t.Fatalf("write map part: %v", err)
+	}
+
+	filePart, err := mw.CreateFormFile("file", "upload.txt")
+	if err != nil {
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+	if _, err := filePart.Write([]byte("content")); err != nil {
+		t.Fatalf("write file part: %v", err)
+	}
+
+	if err := mw.Close(); err != nil {
+		t.Fatalf("close multipart writer: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/graphql", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+// TestMultipartRejectsMapKeyWithNoPaths and
+// TestMultipartRejectsMapKeyWithPathOutsideVariables cover the two ways a
+// `map` entry can fail to resolve to a path under variables: no paths at
+// all, and a path that doesn't start with "variables".
+func TestMultipartRejectsMapKeyWithNoPaths(t *testing.T) {
+	h := &Handler{
+		Executor: func(request *Request) interface{} {
+			t.Fatal("Executor ran for a map with no paths for its key")
+			return nil
+		},
+	}
+
+	req := newMultipartRequestWithMap(t, `{"file":[]}`)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d; body %s", rec.Code, http.StatusBadRequest, rec.Body.String())
+	}
+}
+
+func TestMultipartRejectsMapKeyWithPathOutsideVariables(t *testing.T) {
+	h := &Handler{
+		Executor: func(request *Request) interface{} {
+			t.Fatal("Executor ran for a map path outside variables")
+			return nil
+		},
+	}
+
+	req := newMultipartRequestWithMap(t, `{"file":["operationName"]}`)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d; body %s", rec.Code, http.StatusBadRequest, rec.Body.String())
+	}
+}
+
+// TestMultipartUploadContentFlowsThroughToExecutor guards against the
+// multipart loop handing Executor a *multipart.Part that NextPart() has
+// already invalidated: it reads variables.file.File inside Executor, the
+// same way a resolver would, and asserts the real uploaded bytes come back.
+func TestMultipartUploadContentFlowsThroughToExecutor(t *testing.T) {
+	want := []byte("hello from a real upload")
+	var got []byte
+	var gotSize int64
+
+	h := &Handler{
+		Executor: func(request *Request) interface{} {
+			upload, ok := request.Variables["file"].(Upload)
+			if !ok {
+				t.Fatalf("variables.file = %#v, want Upload", request.Variables["file"])
+			}
+			var err error
+			got, err = io.ReadAll(upload.File)
+			if err != nil {
+				t.Fatalf("reading upload.File: %v", err)
+			}
+			gotSize = upload.Size
+			return map[string]interface{}{"ok": true}
+		},
+	}
+
+	req := newMultipartUploadRequest(t, want)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body.String())
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("upload content = %q, want %q", got, want)
+	}
+	if gotSize != int64(len(want)) {
+		t.Fatalf("upload.Size = %d, want %d", gotSize, len(want))
+	}
+}
+
+// TestUploadTempFileIsRemovedAfterRequest guards the cleanup side of
+// spooling uploads to disk: the temp file readPart creates must not
+// outlive the request, whether or not the resolver closed it itself.
+func TestUploadTempFileIsRemovedAfterRequest(t *testing.T) {
+	var tempPath string
+
+	h := &Handler{
+		Executor: func(request *Request) interface{} {
+			upload := request.Variables["file"].(Upload)
+			tempPath = upload.File.(*os.File).Name()
+			if _, err := os.Stat(tempPath); err != nil {
+				t.Fatalf("temp file missing while Executor is still running: %v", err)
+			}
+			return map[string]interface{}{"ok": true}
+		},
+	}
+
+	req := newMultipartUploadRequest(t, []byte("disk-spooled content"))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if _, err := os.Stat(tempPath); !os.IsNotExist(err) {
+		t.Fatalf("temp file %q still exists after ServeHTTP returned: %v", tempPath, err)
+	}
+}
+
+// TestMaxFileSizeRejectsOversizedUpload and TestMaxFileSizeAllowsUploadAtTheLimit
+// exercise the MaxFileSize boundary: one byte over the limit must be
+// rejected with 413, and a file at exactly the limit must still go through.
+func TestMaxFileSizeRejectsOversizedUpload(t *testing.T) {
+	h := &Handler{
+		MaxFileSize: 8,
+		Executor: func(request *Request) interface{} {
+			t.Fatal("Executor ran for an upload that should have been rejected")
+			return nil
+		},
+	}
+
+	req := newMultipartUploadRequest(t, []byte("this content is well over eight bytes"))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want %d; body %s", rec.Code, http.StatusRequestEntityTooLarge, rec.Body.String())
+	}
+}
+
+func TestMaxFileSizeAllowsUploadAtTheLimit(t *testing.T) {
+	content := []byte("12345678") // exactly MaxFileSize below
+	var got []byte
+
+	h := &Handler{
+		MaxFileSize: int64(len(content)),
+		Executor: func(request *Request) interface{} {
+			upload := request.Variables["file"].(Upload)
+			var err error
+			got, err = io.ReadAll(upload.File)
+			if err != nil {
+				t.Fatalf("reading upload.File: %v", err)
+			}
+			return map[string]interface{}{"ok": true}
+		},
+	}
+
+	req := newMultipartUploadRequest(t, content)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body.String())
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("upload content = %q, want %q", got, content)
+	}
+}
+
+// TestMaxBodySizeRejectsOversizedJSON and TestMaxBodySizeAllowsBodyAtTheLimit
+// exercise the same boundary for MaxBodySize on a plain JSON request.
+func TestMaxBodySizeRejectsOversizedJSON(t *testing.T) {
+	h := &Handler{
+		MaxBodySize: 16,
+		Executor: func(request *Request) interface{} {
+			t.Fatal("Executor ran for a body that should have been rejected")
+			return nil
+		},
+	}
+
+	body := `{"query":"{ this query is longer than sixteen bytes }"}`
+	req := httptest.NewRequest("POST", "/graphql", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want %d; body %s", rec.Code, http.StatusRequestEntityTooLarge, rec.Body.String())
+	}
+}
+
+func TestMaxBodySizeAllowsBodyAtTheLimit(t *testing.T) {
+	body := `{"query":"{a}"}`
+	h := &Handler{
+		MaxBodySize: int64(len(body)),
+		Executor: func(request *Request) interface{} {
+			return map[string]interface{}{"ok": true}
+		},
+	}
+
+	req := httptest.NewRequest("POST", "/graphql", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d; body %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+}
+
+// TestValidationErrorsReportedToErrorHandler guards that an over-limit
+// request is rejected through Handler.ErrorHandler rather than a bare
+// http.Error that bypasses it -- a consumer wiring it up for metrics or
+// error reporting would otherwise never see it.
+func TestValidationErrorsReportedToErrorHandler(t *testing.T) {
+	var reported []error
+	h := &Handler{
+		MaxBodySize: 4,
+		ErrorHandler: func(ctx context.Context, err error) {
+			reported = append(reported, err)
+		},
+		Executor: func(request *Request) interface{} {
+			t.Fatal("Executor ran for a request that should have been rejected")
+			return nil
+		},
+	}
+
+	body := `{"query":"way over four bytes"}`
+	req := httptest.NewRequest("POST", "/graphql", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want %d; body %s", rec.Code, http.StatusRequestEntityTooLarge, rec.Body.String())
+	}
+	if len(reported) != 1 {
+		t.Fatalf("ErrorHandler was called %d times, want 1", len(reported))
+	}
+}
@@ -0,0 +1,75 @@
+package handler
+
+import "testing"
+
+// TestSetGrowsSliceBeyondPlaceholderLength is the regression test for the
+// bug a98b38a had to come back and fix: growing container via append can
+// reallocate its backing array, and the grown slice must be written back
+// into its parent (here, the "files" key in variables) or the appended
+// value is silently lost even though set() reports no error.
+func TestSetGrowsSliceBeyondPlaceholderLength(t *testing.T) {
+	var root interface{} = map[string]interface{}{
+		"variables": map[string]interface{}{
+			"files": []interface{}{},
+		},
+	}
+
+	if err := set("upload-0", &root, "variables.files.0"); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	files := root.(map[string]interface{})["variables"].(map[string]interface{})["files"].([]interface{})
+	if len(files) != 1 {
+		t.Fatalf("variables.files = %v, want a 1-element slice", files)
+	}
+	if files[0] != "upload-0" {
+		t.Fatalf("variables.files[0] = %v, want %q", files[0], "upload-0")
+	}
+}
+
+// TestSetGrowsSliceAcrossMultipleIndexes exercises growth past more than
+// one missing slot, and that earlier auto-vivified slots (left as nil
+// placeholders) don't clobber a value set at a later index first.
+func TestSetGrowsSliceAcrossMultipleIndexes(t *testing.T) {
+	var root interface{} = map[string]interface{}{
+		"variables": map[string]interface{}{
+			"files": []interface{}{},
+		},
+	}
+
+	if err := set("upload-2", &root, "variables.files.2"); err != nil {
+		t.Fatalf("set(...2): %v", err)
+	}
+	if err := set("upload-0", &root, "variables.files.0"); err != nil {
+		t.Fatalf("set(...0): %v", err)
+	}
+
+	files := root.(map[string]interface{})["variables"].(map[string]interface{})["files"].([]interface{})
+	if len(files) != 3 {
+		t.Fatalf("variables.files = %v, want a 3-element slice", files)
+	}
+	if files[0] != "upload-0" || files[1] != nil || files[2] != "upload-2" {
+		t.Fatalf("variables.files = %v, want [upload-0, nil, upload-2]", files)
+	}
+}
+
+// TestSetAutoVivifiesMissingSlice covers the no-placeholder-at-all case:
+// "files" doesn't exist in variables yet, so set() must create the slice
+// itself and still write it back up to the containing map.
+func TestSetAutoVivifiesMissingSlice(t *testing.T) {
+	var root interface{} = map[string]interface{}{
+		"variables": map[string]interface{}{},
+	}
+
+	if err := set("upload-0", &root, "variables.files.0"); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	files, ok := root.(map[string]interface{})["variables"].(map[string]interface{})["files"].([]interface{})
+	if !ok {
+		t.Fatalf("variables.files = %#v, want an auto-vivified []interface{}", root.(map[string]interface{})["variables"].(map[string]interface{})["files"])
+	}
+	if len(files) != 1 || files[0] != "upload-0" {
+		t.Fatalf("variables.files = %v, want [upload-0]", files)
+	}
+}
@@ -0,0 +1,300 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Subscriber executes a subscription operation and returns a channel that
+// emits one value per published event, analogous to how Executor returns
+// one value per query/mutation. The subscription must stop publishing and
+// the channel must eventually be closed once ctx is cancelled.
+type Subscriber func(ctx context.Context, request *Request) (<-chan interface{}, error)
+
+// Subprotocols negotiated over Sec-WebSocket-Protocol, newest first so a
+// client advertising both gets graphql-transport-ws.
+const (
+	subprotocolTransportWS = "graphql-transport-ws" // github.com/enisdenjo/graphql-ws
+	subprotocolLegacyWS    = "graphql-ws"           // subscriptions-transport-ws (deprecated upstream, still widely deployed)
+)
+
+const (
+	keepAliveInterval = 20 * time.Second
+	wsWriteTimeout    = 10 * time.Second
+)
+
+var wsUpgrader = websocket.Upgrader{
+	Subprotocols: []string{subprotocolTransportWS, subprotocolLegacyWS},
+	CheckOrigin:  func(r *http.Request) bool { return true },
+}
+
+// message is the frame shape shared by both subprotocols; which `Type`
+// strings are in play depends on which protocol was negotiated.
+type message struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// protocolFrames holds the type strings a subprotocol uses for each frame,
+// so the connection loop below can stay protocol-agnostic.
+type protocolFrames struct {
+	start, stop               string // client -> server: begin/end an operation
+	data, errorType, complete string // server -> client: per-operation frames
+	keepAlive                 string // server -> client: idle heartbeat
+}
+
+var legacyFrames = protocolFrames{
+	start: "start", stop: "stop",
+	data: "data", errorType: "error", complete: "complete",
+	keepAlive: "ka",
+}
+
+var transportWSFrames = protocolFrames{
+	start: "subscribe", stop: "complete",
+	data: "next", errorType: "error", complete: "complete",
+	keepAlive: "ping",
+}
+
+func isWebsocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// serveWS upgrades r to a websocket and speaks whichever of
+// subscriptions-transport-ws or graphql-transport-ws the client negotiated
+// via Sec-WebSocket-Protocol, reusing the same header/remote-ip context
+// propagation as the HTTP path so auth middleware keeps working.
+func (self *Handler) serveWS(w http.ResponseWriter, r *http.Request) {
+	if self.Subscriber == nil {
+		http.Error(w, "Subscriptions not supported", http.StatusNotImplemented)
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// wsUpgrader.Upgrade already wrote an HTTP error response.
+		self.reportError(r.Context(), err)
+		return
+	}
+
+	frames := transportWSFrames
+	if conn.Subprotocol() == subprotocolLegacyWS {
+		frames = legacyFrames
+	}
+
+	c := &wsConnection{
+		handler:  self,
+		conn:     conn,
+		frames:   frames,
+		header:   r.Header,
+		remoteIp: getRemoteIp(r),
+		ops:      map[string]context.CancelFunc{},
+		pongCh:   make(chan struct{}, 1),
+	}
+	c.run(r.Context())
+}
+
+// wsConnection tracks the running subscriptions for a single client
+// connection so `stop`/`complete` and connection teardown can cancel the
+// right one without tearing down its siblings.
+type wsConnection struct {
+	handler  *Handler
+	conn     *websocket.Conn
+	frames   protocolFrames
+	header   http.Header
+	remoteIp string
+
+	writeMu sync.Mutex
+
+	opsMu sync.Mutex
+	ops   map[string]context.CancelFunc
+
+	// pongCh is signalled by a "pong" frame from the client, so keepAlive
+	// can tell a half-open connection (no TCP RST, just nothing on the
+	// other end) apart from one that's still there but quiet.
+	pongCh chan struct{}
+}
+
+func (c *wsConnection) run(parent context.Context) {
+	defer c.conn.Close()
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	defer c.stopAll()
+
+	go c.keepAlive(ctx)
+
+	for {
+		var msg message
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case "connection_init":
+			c.writeJSON(message{Type: "connection_ack"})
+		case "connection_terminate":
+			return
+		case "ping":
+			c.writeJSON(message{Type: "pong"})
+		case "pong":
+			select {
+			case c.pongCh <- struct{}{}:
+			default:
+				// keepAlive hasn't consumed the last pong yet; one
+				// pending pong is all it needs to know the peer is alive.
+			}
+		case c.frames.start:
+			c.startOperation(ctx, msg)
+		case c.frames.stop:
+			c.stopOperation(msg.ID)
+		default:
+			c.sendError(msg.ID, errors.New("unknown message type "+msg.Type))
+		}
+	}
+}
+
+// maxMissedPongs is how many keepAlive intervals can pass without a "pong"
+// from the client before the connection is presumed dead and torn down.
+// Only the graphql-transport-ws protocol sends a "pong" in reply to our
+// heartbeat ("ping"); the legacy graphql-ws protocol's heartbeat ("ka")
+// has no client ack, so missed-pong detection is skipped there.
+const maxMissedPongs = 2
+
+func (c *wsConnection) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if c.frames.keepAlive == "ping" {
+				select {
+				case <-c.pongCh:
+					missed = 0
+				default:
+					missed++
+					if missed > maxMissedPongs {
+						// No pong in maxMissedPongs intervals: the peer is
+						// gone without ever sending a TCP RST (e.g. a dead
+						// NAT binding). Close so run()'s ReadJSON unblocks
+						// and the connection's goroutines unwind.
+						c.conn.Close()
+						return
+					}
+				}
+			}
+			if err := c.writeJSON(message{Type: c.frames.keepAlive}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// startOperation registers the operation and hands it off to its own
+// goroutine. Registration happens synchronously, on run()'s goroutine, so
+// a "stop" for the same ID arriving right behind "start" is never missed
+// or reordered; the rest -- calling the possibly slow/blocking Subscriber
+// and then pumping its events -- runs off the read loop, so one slow
+// subscription can't stall every other frame (a different op's "stop", a
+// ping reply, connection_terminate) on this connection.
+func (c *wsConnection) startOperation(parent context.Context, msg message) {
+	var request Request
+	if err := json.Unmarshal(msg.Payload, &request); err != nil {
+		c.sendError(msg.ID, err)
+		return
+	}
+
+	opCtx, cancel := context.WithCancel(parent)
+	request.Context = context.WithValue(opCtx, "header", c.header)
+	request.Context = context.WithValue(request.Context, "remote-ip", c.remoteIp)
+
+	c.opsMu.Lock()
+	if _, running := c.ops[msg.ID]; running {
+		c.opsMu.Unlock()
+		cancel()
+		return
+	}
+	c.ops[msg.ID] = cancel
+	c.opsMu.Unlock()
+
+	go c.runOperation(opCtx, msg.ID, &request)
+}
+
+// runOperation calls the Subscriber and pumps its events until the
+// subscription completes, errors, or opCtx is cancelled (by "stop" or
+// connection teardown). opCtx is derived only from c's connection-level
+// context, never a sibling's, so a sibling operation's failure or stop
+// cannot cancel it.
+func (c *wsConnection) runOperation(opCtx context.Context, id string, request *Request) {
+	events, err := c.handler.Subscriber(opCtx, request)
+	if err != nil {
+		c.sendError(id, err)
+		c.stopOperation(id)
+		return
+	}
+
+	defer c.stopOperation(id)
+	for {
+		select {
+		case <-opCtx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				c.writeJSON(message{ID: id, Type: c.frames.complete})
+				return
+			}
+			payload, err := json.Marshal(event)
+			if err != nil {
+				c.sendError(id, err)
+				return
+			}
+			c.writeJSON(message{ID: id, Type: c.frames.data, Payload: payload})
+		}
+	}
+}
+
+// stopOperation cancels the subscription behind id, whether it is being
+// stopped by the client, by the subscriber finishing on its own, or by
+// connection teardown.
+func (c *wsConnection) stopOperation(id string) {
+	c.opsMu.Lock()
+	cancel, ok := c.ops[id]
+	if ok {
+		delete(c.ops, id)
+	}
+	c.opsMu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+func (c *wsConnection) stopAll() {
+	c.opsMu.Lock()
+	defer c.opsMu.Unlock()
+	for id, cancel := range c.ops {
+		cancel()
+		delete(c.ops, id)
+	}
+}
+
+func (c *wsConnection) writeJSON(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteJSON(v)
+}
+
+func (c *wsConnection) sendError(id string, err error) {
+	payload, _ := json.Marshal(map[string]string{"message": err.Error()})
+	c.writeJSON(message{ID: id, Type: c.frames.errorType, Payload: payload})
+}
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialSubscriptions starts an httptest server for h and opens a
+// graphql-transport-ws connection to it, completing the connection_init
+// handshake before returning.
+func dialSubscriptions(t *testing.T, h *Handler) *websocket.Conn {
+	t.Helper()
+
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/subscriptions"
+	dialer := websocket.Dialer{Subprotocols: []string{"graphql-transport-ws"}}
+	conn, _, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if err := conn.WriteJSON(map[string]string{"type": "connection_init"}); err != nil {
+		t.Fatalf("write connection_init: %v", err)
+	}
+	var ack map[string]interface{}
+	if err := conn.ReadJSON(&ack); err != nil {
+		t.Fatalf("read connection_ack: %v", err)
+	}
+	if ack["type"] != "connection_ack" {
+		t.Fatalf("ack = %v, want type connection_ack", ack)
+	}
+	return conn
+}
+
+// TestSubscriptionDataFlowsAndStops drives a real connection through
+// subscribe, reads the event the Subscriber publishes, then stops the
+// operation and asserts the Subscriber's context is cancelled in response.
+func TestSubscriptionDataFlowsAndStops(t *testing.T) {
+	cancelled := make(chan struct{})
+
+	h := &Handler{
+		Subscriber: func(ctx context.Context, request *Request) (<-chan interface{}, error) {
+			events := make(chan interface{}, 1)
+			events <- map[string]interface{}{"n": 1}
+			go func() {
+				<-ctx.Done()
+				close(cancelled)
+			}()
+			return events, nil
+		},
+	}
+
+	conn := dialSubscriptions(t, h)
+
+	if err := conn.WriteJSON(map[string]interface{}{
+		"id":      "1",
+		"type":    "subscribe",
+		"payload": map[string]interface{}{"query": "subscription { n }"},
+	}); err != nil {
+		t.Fatalf("write subscribe: %v", err)
+	}
+
+	var next struct {
+		ID      string
+		Type    string
+		Payload json.RawMessage
+	}
+	if err := conn.ReadJSON(&next); err != nil {
+		t.Fatalf("read data frame: %v", err)
+	}
+	if next.ID != "1" || next.Type != "next" {
+		t.Fatalf("frame = %+v, want id 1 type next", next)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(next.Payload, &payload); err != nil {
+		t.Fatalf("decode payload: %v", err)
+	}
+	if payload["n"] != float64(1) {
+		t.Fatalf("payload = %v, want {n: 1}", payload)
+	}
+
+	if err := conn.WriteJSON(map[string]string{"id": "1", "type": "complete"}); err != nil {
+		t.Fatalf("write complete: %v", err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Subscriber's context was never cancelled after stop")
+	}
+}
+
+// TestSubscriptionCancelledOnDisconnect asserts that closing the client
+// connection without an explicit "complete" still cancels any running
+// operation's context, via run()'s deferred stopAll.
+func TestSubscriptionCancelledOnDisconnect(t *testing.T) {
+	cancelled := make(chan struct{})
+
+	h := &Handler{
+		Subscriber: func(ctx context.Context, request *Request) (<-chan interface{}, error) {
+			events := make(chan interface{})
+			go func() {
+				<-ctx.Done()
+				close(cancelled)
+			}()
+			return events, nil
+		},
+	}
+
+	conn := dialSubscriptions(t, h)
+
+	if err := conn.WriteJSON(map[string]interface{}{
+		"id":      "1",
+		"type":    "subscribe",
+		"payload": map[string]interface{}{"query": "subscription { n }"},
+	}); err != nil {
+		t.Fatalf("write subscribe: %v", err)
+	}
+
+	// Give the server a moment to register and start the operation before
+	// we pull the rug out from under it.
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Subscriber's context was never cancelled after the client disconnected")
+	}
+}